@@ -0,0 +1,92 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"github.com/Arceliar/phony"
+)
+
+// peerAnnouncementQueue delivers root announcements to a single peer
+// off of the state actor. Signing and marshalling an announcement for
+// one peer happens inside this worker rather than inside state, so a
+// slow or blocked link can't stall delivery to healthy peers.
+//
+// Only the latest pending announcement is ever kept: a fresher update
+// replaces whatever was queued rather than appending to it, since a
+// peer only ever needs to hear about the newest root.
+type peerAnnouncementQueue struct {
+	phony.Inbox
+	peer    *peer
+	pending *rootAnnouncementWithTime
+	dropped uint64
+	sending bool
+}
+
+func newPeerAnnouncementQueue(p *peer) *peerAnnouncementQueue {
+	return &peerAnnouncementQueue{peer: p}
+}
+
+// enqueue records ann as the latest announcement waiting to be sent to
+// the queue's peer, replacing whatever was queued before. The actual
+// signing and sending happens on a dedicated goroutine outside of the
+// Inbox's own queue, so a blocked peer.proto.push can never stall this
+// or any other enqueue() call while it's in flight.
+func (q *peerAnnouncementQueue) enqueue(ann *rootAnnouncementWithTime) {
+	q.Act(nil, func() {
+		if q.pending != nil {
+			q.dropped++
+		}
+		q.pending = ann
+		if !q.sending {
+			q.sending = true
+			go q._drain()
+		}
+	})
+}
+
+// _drain signs and sends the latest pending announcement, then checks
+// again for anything that arrived while it was sending, so a burst of
+// updates collapses down to delivering only the last one.
+func (q *peerAnnouncementQueue) _drain() {
+	for {
+		var ann *rootAnnouncementWithTime
+		phony.Block(q, func() {
+			ann = q.pending
+			q.pending = nil
+			if ann == nil {
+				q.sending = false
+			}
+		})
+		if ann == nil {
+			return
+		}
+		if frame := ann.forPeer(q.peer); frame != nil {
+			q.peer.proto.push(frame)
+		}
+	}
+}
+
+// depth reports whether an announcement is currently queued (at most
+// one ever is) along with the number dropped in favour of a fresher
+// update, for surfacing via PeerInfo.
+func (q *peerAnnouncementQueue) depth() (pending int, dropped uint64) {
+	phony.Block(q, func() {
+		if q.pending != nil {
+			pending = 1
+		}
+		dropped = q.dropped
+	})
+	return
+}
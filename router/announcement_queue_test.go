@@ -0,0 +1,48 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "testing"
+
+// sending is preset to true so enqueue never spawns the _drain
+// goroutine, letting the drop/replace bookkeeping be inspected
+// synchronously via depth() instead of racing a live drain.
+func TestPeerAnnouncementQueueKeepsOnlyLatestPending(t *testing.T) {
+	q := &peerAnnouncementQueue{sending: true}
+	first := &rootAnnouncementWithTime{}
+	second := &rootAnnouncementWithTime{}
+
+	q.enqueue(first)
+	q.enqueue(second)
+
+	pending, dropped := q.depth()
+	if pending != 1 {
+		t.Fatalf("expected exactly one announcement pending, got %d", pending)
+	}
+	if dropped != 1 {
+		t.Fatalf("expected the first announcement to be dropped in favour of the second, got %d", dropped)
+	}
+	if q.pending != second {
+		t.Fatal("expected the most recently enqueued announcement to be the one kept")
+	}
+}
+
+func TestPeerAnnouncementQueueDepthWithNothingPending(t *testing.T) {
+	q := &peerAnnouncementQueue{sending: true}
+	pending, dropped := q.depth()
+	if pending != 0 || dropped != 0 {
+		t.Fatalf("expected a fresh queue to report no pending or dropped announcements, got pending=%d dropped=%d", pending, dropped)
+	}
+}
@@ -31,11 +31,13 @@ type NeighbourInfo struct {
 }
 
 type PeerInfo struct {
-	URI       string
-	Port      int
-	PublicKey string
-	PeerType  int
-	Zone      string
+	URI             string
+	Port            int
+	PublicKey       string
+	PeerType        int
+	Zone            string
+	AnnounceQueued  int
+	AnnounceDropped uint64
 }
 
 type NodeState struct {
@@ -102,6 +104,43 @@ func (r *Router) Coords() types.Coordinates {
 	return r.state.coords()
 }
 
+// handleFrame is the router's general inbound frame dispatch point,
+// called by the peer's frame-receive path for every frame read off
+// the wire. Tree announcements go to the state actor as before;
+// pathfinder and PEX frame types are routed to the subsystem that
+// owns them. Any other frame type is not handled here and nil is
+// returned.
+func (r *Router) handleFrame(from *peer, f *types.Frame) error {
+	if f.Type == types.TypeSTP {
+		return r.state._handleTreeAnnouncement(from, f)
+	}
+	if handled, err := r.pathfinder.handleFrame(from, f); handled {
+		return err
+	}
+	if f.Type == types.TypePeerExchange {
+		return r.pex.handleFrame(from, f)
+	}
+	return nil
+}
+
+// AddressBook returns every peer address this router currently knows
+// about via peer exchange, whether or not it is dial-able right now.
+func (r *Router) AddressBook() []PeerInfo {
+	return r.addressBook.snapshot()
+}
+
+// AutoConnect ensures that at least min outbound, tree-relevant peers
+// stay connected, dialling candidates out of the address book learned
+// via peer exchange whenever the current count drops below min. This
+// removes the need for embedding applications to maintain a static
+// peer list.
+func (r *Router) AutoConnect(min int) {
+	r.autoConnect.Act(nil, func() {
+		r.autoConnect.min = min
+		r.autoConnect._check()
+	})
+}
+
 func (r *Router) Peers() []PeerInfo {
 	var infos []PeerInfo
 	phony.Block(r.state, func() {
@@ -109,18 +148,37 @@ func (r *Router) Peers() []PeerInfo {
 			if p == nil {
 				continue
 			}
+			queued, dropped := p._announceQueue.depth()
 			infos = append(infos, PeerInfo{
-				URI:       string(p.uri),
-				Port:      int(p.port),
-				PublicKey: hex.EncodeToString(p.public[:]),
-				PeerType:  int(p.peertype),
-				Zone:      string(p.zone),
+				URI:             string(p.uri),
+				Port:            int(p.port),
+				PublicKey:       hex.EncodeToString(p.public[:]),
+				PeerType:        int(p.peertype),
+				Zone:            string(p.zone),
+				AnnounceQueued:  queued,
+				AnnounceDropped: dropped,
 			})
 		}
 	})
 	return infos
 }
 
+// PeerStats returns the rolling root-announcement quality statistics
+// kept for each currently-known peer, keyed by public key. These feed
+// parent selection and are also useful for diagnosing churn.
+func (r *Router) PeerStats() map[types.PublicKey]PeerStats {
+	stats := map[types.PublicKey]PeerStats{}
+	phony.Block(r.state, func() {
+		for _, p := range r.state._peers {
+			if p == nil {
+				continue
+			}
+			stats[p.public] = p._stats.snapshot()
+		}
+	})
+	return stats
+}
+
 func (r *Router) NextHop(from net.Addr, frameType types.FrameType, dest net.Addr) net.Addr {
 	var fromPeer *peer
 	var nexthop net.Addr
@@ -136,9 +194,17 @@ func (r *Router) NextHop(from net.Addr, frameType types.FrameType, dest net.Addr
 	}
 
 	var nextPeer *peer
-	phony.Block(r.state, func() {
-		nextPeer, _ = r.state._nextHopsFor(fromPeer, frameType, dest, types.VirtualSnakeWatermark{PublicKey: types.FullMask})
-	})
+	if pk, ok := dest.(types.PublicKey); ok {
+		nextPeer = r.pathfinder.nextHop(pk)
+	}
+	if nextPeer == nil {
+		phony.Block(r.state, func() {
+			nextPeer, _ = r.state._nextHopsFor(fromPeer, frameType, dest, types.VirtualSnakeWatermark{PublicKey: types.FullMask})
+		})
+		if pk, ok := dest.(types.PublicKey); ok && nextPeer != nil {
+			r.pathfinder.notifyUse(pk)
+		}
+	}
 
 	if nextPeer != nil {
 		switch (dest).(type) {
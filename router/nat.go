@@ -0,0 +1,174 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+)
+
+// natLeaseDuration is how long a port mapping is requested for. It is
+// renewed well before expiry so a missed renewal doesn't immediately
+// drop the mapping.
+const natLeaseDuration = time.Hour
+
+// natRenewInterval is how often the lease is refreshed.
+const natRenewInterval = time.Minute * 30
+
+// natMapping tracks an active external port mapping obtained via
+// UPnP or NAT-PMP, and the background goroutine that keeps it
+// renewed.
+type natMapping struct {
+	method       string
+	externalAddr string
+	cancel       context.CancelFunc
+	gateway      natGateway
+	port         int
+}
+
+// natGateway abstracts over the two protocols a home router might
+// speak, following the probe/service-discovery split used by
+// Tendermint's upnp package: try UPnP IGDv1/IGDv2 first via SSDP +
+// SOAP, then fall back to NAT-PMP.
+type natGateway interface {
+	// Method identifies the gateway for logging/events, e.g. "upnp" or "natpmp".
+	Method() string
+	// AddPortMapping requests a TCP mapping from externalPort to our
+	// listener and returns the external IP the gateway reports.
+	AddPortMapping(externalPort int, lease time.Duration) (externalIP string, err error)
+	// DeletePortMapping releases a previously-added mapping.
+	DeletePortMapping(externalPort int) error
+}
+
+// EnableNATMapping probes for a UPnP or NAT-PMP gateway on the local
+// network and, if one is found, requests a port mapping for
+// externalPort onto this node's listener, publishing the discovered
+// dial-able external address as events.NATStatus and folding it into
+// outgoing PEX advertisements. It is not added to the PeerInfo entries
+// returned by Peers(). Failures are non-fatal: a node behind
+// a NAT it can't traverse simply isn't reachable from the outside and
+// keeps working as normal otherwise.
+func (r *Router) EnableNATMapping(ctx context.Context, externalPort int) {
+	go r.maintainNATMapping(ctx, externalPort)
+}
+
+func (r *Router) maintainNATMapping(ctx context.Context, externalPort int) {
+	gw, err := discoverNATGateway(ctx)
+	if err != nil {
+		r._publish(events.NATStatus{Err: err})
+		return
+	}
+
+	mappingCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	mapping := &natMapping{gateway: gw, method: gw.Method(), port: externalPort, cancel: cancel}
+	r.natMapping.Act(nil, func() { r.natMapping.current = mapping })
+	defer func() {
+		r.natMapping.Act(nil, func() {
+			if r.natMapping.current == mapping {
+				r.natMapping.current = nil
+			}
+		})
+		_ = gw.DeletePortMapping(externalPort)
+	}()
+
+	if !r.renewNATMapping(mapping) {
+		return
+	}
+	leaseExpiry := time.Now().Add(natLeaseDuration)
+
+	ticker := time.NewTicker(natRenewInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-mappingCtx.Done():
+			return
+		case <-ticker.C:
+			if r.renewNATMapping(mapping) {
+				leaseExpiry = time.Now().Add(natLeaseDuration)
+				continue
+			}
+			// A single failed renewal shouldn't tear the mapping down
+			// immediately: the existing lease is still good until
+			// leaseExpiry, so keep retrying on a shorter cadence
+			// before giving up.
+			if !r.retryNATMappingUntil(mappingCtx, mapping, leaseExpiry) {
+				return
+			}
+			leaseExpiry = time.Now().Add(natLeaseDuration)
+		}
+	}
+}
+
+// retryNATMappingUntil retries renewing mapping on a shorter cadence
+// than the usual natRenewInterval, stopping as soon as a renewal
+// succeeds or once deadline (the point the existing lease actually
+// expires) has passed without one.
+func (r *Router) retryNATMappingUntil(ctx context.Context, mapping *natMapping, deadline time.Time) bool {
+	retry := time.NewTicker(time.Minute)
+	defer retry.Stop()
+	for time.Now().Before(deadline) {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-retry.C:
+			if r.renewNATMapping(mapping) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *Router) renewNATMapping(mapping *natMapping) bool {
+	externalIP, err := mapping.gateway.AddPortMapping(mapping.port, natLeaseDuration)
+	if err != nil {
+		r._publish(events.NATStatus{Method: mapping.method, Err: err})
+		return false
+	}
+	mapping.externalAddr = fmt.Sprintf("%s:%d", externalIP, mapping.port)
+	r._publish(events.NATStatus{Method: mapping.method, ExternalAddr: mapping.externalAddr})
+	return true
+}
+
+// natExternalURI returns the dial-able URI for the currently mapped
+// external address, if any, for inclusion in outgoing PEX
+// advertisements. It returns "" if no mapping is active.
+func (r *Router) natExternalURI() string {
+	var uri string
+	phony.Block(&r.natMapping, func() {
+		if m := r.natMapping.current; m != nil && m.externalAddr != "" {
+			uri = fmt.Sprintf("tcp://%s", m.externalAddr)
+		}
+	})
+	return uri
+}
+
+// discoverNATGateway probes for a UPnP IGDv1/IGDv2 gateway via SSDP
+// M-SEARCH, falling back to NAT-PMP if none responds.
+func discoverNATGateway(ctx context.Context) (natGateway, error) {
+	if gw, err := discoverUPnPGateway(ctx); err == nil {
+		return gw, nil
+	}
+	if gw, err := discoverNATPMPGateway(ctx); err == nil {
+		return gw, nil
+	}
+	return nil, fmt.Errorf("no UPnP or NAT-PMP gateway found")
+}
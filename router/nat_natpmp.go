@@ -0,0 +1,134 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// natPMPPort is the well-known NAT-PMP port on the gateway.
+const natPMPPort = 5351
+
+// natpmpGateway implements natGateway using the NAT-PMP protocol
+// (RFC 6886), talking to the default gateway on the local network.
+type natpmpGateway struct {
+	gatewayIP net.IP
+}
+
+func (g *natpmpGateway) Method() string { return "natpmp" }
+
+func (g *natpmpGateway) AddPortMapping(externalPort int, lease time.Duration) (string, error) {
+	req := make([]byte, 12)
+	req[0] = 0 // version
+	req[1] = 2 // opcode: map TCP
+	binary.BigEndian.PutUint16(req[4:6], uint16(externalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], uint32(lease.Seconds()))
+
+	resp, err := g.roundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	if len(resp) < 16 || resp[1] != 130 {
+		return "", fmt.Errorf("unexpected NAT-PMP mapping response")
+	}
+	resultCode := binary.BigEndian.Uint16(resp[2:4])
+	if resultCode != 0 {
+		return "", fmt.Errorf("NAT-PMP mapping rejected: code %d", resultCode)
+	}
+
+	return g.externalIP()
+}
+
+func (g *natpmpGateway) DeletePortMapping(externalPort int) error {
+	req := make([]byte, 12)
+	req[0] = 0
+	req[1] = 2
+	binary.BigEndian.PutUint16(req[4:6], uint16(externalPort))
+	// A requested lifetime of 0 tells the gateway to delete the mapping.
+	_, err := g.roundTrip(req)
+	return err
+}
+
+func (g *natpmpGateway) externalIP() (string, error) {
+	req := []byte{0, 0}
+	resp, err := g.roundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	if len(resp) < 12 || resp[1] != 128 {
+		return "", fmt.Errorf("unexpected NAT-PMP external address response")
+	}
+	ip := net.IP(resp[8:12])
+	return ip.String(), nil
+}
+
+func (g *natpmpGateway) roundTrip(req []byte) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: g.gatewayIP, Port: natPMPPort})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_ = conn.SetDeadline(time.Now().Add(time.Second * 2))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// discoverNATPMPGateway probes the default gateway with a NAT-PMP
+// external address request and, if it responds, returns a gateway
+// handle for subsequent mapping requests.
+func discoverNATPMPGateway(ctx context.Context) (natGateway, error) {
+	gwIP, err := defaultGatewayIP()
+	if err != nil {
+		return nil, err
+	}
+	gw := &natpmpGateway{gatewayIP: gwIP}
+	if _, err := gw.externalIP(); err != nil {
+		return nil, fmt.Errorf("gateway did not respond to NAT-PMP: %w", err)
+	}
+	return gw, nil
+}
+
+// defaultGatewayIP guesses the local network's default gateway by
+// assuming it sits at the first address of our outbound interface's
+// /24, which holds for the overwhelming majority of home routers.
+func defaultGatewayIP() (net.IP, error) {
+	conn, err := net.Dial("udp4", "203.0.113.1:80")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	local := conn.LocalAddr().(*net.UDPAddr).IP.To4()
+	if local == nil {
+		return nil, fmt.Errorf("no IPv4 outbound address found")
+	}
+	gw := make(net.IP, 4)
+	copy(gw, local)
+	gw[3] = 1
+	return gw, nil
+}
@@ -0,0 +1,235 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ssdpSearchTarget is the service type we probe for: any
+// InternetGatewayDevice, covering both IGDv1 and IGDv2.
+const ssdpSearchTarget = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+// ssdpMulticastAddr is the well-known SSDP multicast group and port.
+const ssdpMulticastAddr = "239.255.255.250:1900"
+
+// upnpGateway implements natGateway against an InternetGatewayDevice
+// discovered via SSDP, issuing AddPortMapping/DeletePortMapping SOAP
+// calls against its WANIPConnection control URL.
+type upnpGateway struct {
+	controlURL string
+	localIP    string
+}
+
+func (g *upnpGateway) Method() string { return "upnp" }
+
+func (g *upnpGateway) AddPortMapping(externalPort int, lease time.Duration) (string, error) {
+	body := fmt.Sprintf(soapAddPortMapping, externalPort, "TCP", externalPort, g.localIP, int(lease.Seconds()))
+	if _, err := g.soapCall("AddPortMapping", body); err != nil {
+		return "", err
+	}
+	return g.externalIP()
+}
+
+func (g *upnpGateway) DeletePortMapping(externalPort int) error {
+	body := fmt.Sprintf(soapDeletePortMapping, externalPort, "TCP")
+	_, err := g.soapCall("DeletePortMapping", body)
+	return err
+}
+
+func (g *upnpGateway) externalIP() (string, error) {
+	resp, err := g.soapCall("GetExternalIPAddress", soapGetExternalIP)
+	if err != nil {
+		return "", err
+	}
+	const open, close = "<NewExternalIPAddress>", "</NewExternalIPAddress>"
+	start := strings.Index(resp, open)
+	end := strings.Index(resp, close)
+	if start < 0 || end < 0 || end < start {
+		return "", fmt.Errorf("malformed GetExternalIPAddress response")
+	}
+	return resp[start+len(open) : end], nil
+}
+
+func (g *upnpGateway) soapCall(action, body string) (string, error) {
+	req, err := http.NewRequest(http.MethodPost, g.controlURL, strings.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"urn:schemas-upnp-org:service:WANIPConnection:1#%s"`, action))
+	client := &http.Client{Timeout: time.Second * 5}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("gateway rejected %s: %s", action, resp.Status)
+	}
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(respBody), nil
+}
+
+// discoverUPnPGateway sends an SSDP M-SEARCH for an
+// InternetGatewayDevice and, on a response, fetches its device
+// description to locate the WANIPConnection control URL.
+func discoverUPnPGateway(ctx context.Context) (natGateway, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	dest, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	search := fmt.Sprintf(ssdpMSearch, ssdpMulticastAddr, ssdpSearchTarget)
+	if _, err := conn.WriteTo([]byte(search), dest); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(time.Second * 3)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	_ = conn.SetReadDeadline(deadline)
+
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		return nil, fmt.Errorf("no SSDP response: %w", err)
+	}
+
+	location := parseSSDPLocation(string(buf[:n]))
+	if location == "" {
+		return nil, fmt.Errorf("SSDP response missing LOCATION header")
+	}
+
+	controlURL, err := fetchWANIPConnectionControlURL(location)
+	if err != nil {
+		return nil, err
+	}
+
+	localIP, err := localAddrFor(location)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upnpGateway{controlURL: controlURL, localIP: localIP}, nil
+}
+
+func parseSSDPLocation(response string) string {
+	for _, line := range strings.Split(response, "\r\n") {
+		if strings.HasPrefix(strings.ToUpper(line), "LOCATION:") {
+			return strings.TrimSpace(line[len("LOCATION:"):])
+		}
+	}
+	return ""
+}
+
+// fetchWANIPConnectionControlURL fetches the IGD's device description
+// XML and extracts the control URL of its WANIPConnection service; a
+// gateway offering only WANPPPConnection is not supported. The lookup
+// is intentionally forgiving of XML dialects between IGDv1 and IGDv2
+// devices.
+func fetchWANIPConnectionControlURL(location string) (string, error) {
+	client := &http.Client{Timeout: time.Second * 5}
+	resp, err := client.Get(location)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	doc := string(body)
+
+	// The controlURL we want is the one inside the WANIPConnection
+	// service element, which follows its serviceType.
+	svc := strings.Index(doc, "urn:schemas-upnp-org:service:WANIPConnection:")
+	if svc < 0 {
+		return "", fmt.Errorf("device description has no WANIPConnection service")
+	}
+	doc = doc[svc:]
+
+	const open, close = "<controlURL>", "</controlURL>"
+	start := strings.Index(doc, open)
+	end := strings.Index(doc, close)
+	if start < 0 || end < 0 || end < start {
+		return "", fmt.Errorf("device description missing controlURL")
+	}
+	path := doc[start+len(open) : end]
+
+	base := location
+	if i := strings.Index(location[len("http://"):], "/"); i >= 0 {
+		base = location[:len("http://")+i]
+	}
+	if strings.HasPrefix(path, "http://") {
+		return path, nil
+	}
+	return base + path, nil
+}
+
+func localAddrFor(location string) (string, error) {
+	u := strings.TrimPrefix(location, "http://")
+	host := u
+	if i := strings.Index(u, "/"); i >= 0 {
+		host = u[:i]
+	}
+	conn, err := net.Dial("udp4", host)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+const ssdpMSearch = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: %s\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 2\r\n" +
+	"ST: %s\r\n\r\n"
+
+const soapGetExternalIP = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:GetExternalIPAddress xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1"/></s:Body>
+</s:Envelope>`
+
+const soapAddPortMapping = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:AddPortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol><NewInternalPort>%d</NewInternalPort>
+<NewInternalClient>%s</NewInternalClient><NewEnabled>1</NewEnabled><NewPortMappingDescription>pinecone</NewPortMappingDescription>
+<NewLeaseDuration>%d</NewLeaseDuration></u:AddPortMapping></s:Body>
+</s:Envelope>`
+
+const soapDeletePortMapping = `<?xml version="1.0"?>
+<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+<s:Body><u:DeletePortMapping xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">
+<NewExternalPort>%d</NewExternalPort><NewProtocol>%s</NewProtocol></u:DeletePortMapping></s:Body>
+</s:Envelope>`
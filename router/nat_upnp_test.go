@@ -0,0 +1,37 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import "testing"
+
+func TestParseSSDPLocation(t *testing.T) {
+	resp := "HTTP/1.1 200 OK\r\n" +
+		"CACHE-CONTROL: max-age=1800\r\n" +
+		"LOCATION: http://192.168.1.1:1900/igd.xml\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+
+	got := parseSSDPLocation(resp)
+	want := "http://192.168.1.1:1900/igd.xml"
+	if got != want {
+		t.Fatalf("parseSSDPLocation() = %q, want %q", got, want)
+	}
+}
+
+func TestParseSSDPLocationMissing(t *testing.T) {
+	resp := "HTTP/1.1 200 OK\r\nCACHE-CONTROL: max-age=1800\r\n\r\n"
+	if got := parseSSDPLocation(resp); got != "" {
+		t.Fatalf("expected no LOCATION header to yield empty string, got %q", got)
+	}
+}
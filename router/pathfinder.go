@@ -0,0 +1,284 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// pathCacheTTL is how long a discovered shortcut path is trusted for
+// before it must be refreshed by a fresh lookup.
+const pathCacheTTL = time.Second * 60
+
+// pathCacheLimit bounds the number of shortcuts a node will remember
+// at once. Entries are evicted least-recently-used once the cache is
+// full.
+const pathCacheLimit = 512
+
+// cachedPath is a source-routed shortcut to a remote node, discovered
+// by the pathfinder and consulted ahead of the tree.
+type cachedPath struct {
+	ports   []types.SwitchPortID
+	expiry  time.Time
+	touched time.Time
+}
+
+func (c *cachedPath) expired() bool {
+	return time.Now().After(c.expiry)
+}
+
+// pathfinder installs and maintains short-lived source-routed
+// shortcuts between this node and frequently-communicating peers, on
+// top of the existing tree and snake routing. It is the Pinecone
+// analogue of the pathfinder embedded in ironwood's dhtree: it lets
+// traffic exploit a direct edge when one has recently been found,
+// while always falling back to tree routing when no shortcut is
+// known or the cached one has gone stale.
+type pathfinder struct {
+	phony.Inbox
+	r         *Router
+	_cache    map[types.PublicKey]*cachedPath
+	_inflight map[types.PublicKey]time.Time
+}
+
+func newPathfinder(r *Router) *pathfinder {
+	return &pathfinder{
+		r:         r,
+		_cache:    map[types.PublicKey]*cachedPath{},
+		_inflight: map[types.PublicKey]time.Time{},
+	}
+}
+
+// nextHop returns the peer a shortcut path to target currently routes
+// through, or nil if there is no live shortcut, in which case the
+// caller should fall back to tree routing. A hit refreshes the
+// entry's TTL since it shows the path is still in active use.
+func (p *pathfinder) nextHop(target types.PublicKey) *peer {
+	var next *peer
+	phony.Block(p, func() {
+		path, ok := p._cache[target]
+		if !ok || path.expired() || len(path.ports) == 0 {
+			return
+		}
+		phony.Block(p.r.state, func() {
+			next = p.r.state._peerForPort(path.ports[0])
+		})
+		if next == nil || !next.started.Load() {
+			delete(p._cache, target)
+			next = nil
+			return
+		}
+		path.touched = time.Now()
+		path.expiry = path.touched.Add(pathCacheTTL)
+	})
+	return next
+}
+
+// notifyUse is called whenever a packet is sent towards target over
+// the tree fallback. Unless a shortcut to target is already cached or
+// a lookup for it was sent within the last pathCacheTTL, a lookup is
+// sent straight away to try to discover a shortcut for future packets.
+func (p *pathfinder) notifyUse(target types.PublicKey) {
+	p.Act(nil, func() {
+		if _, ok := p._cache[target]; ok {
+			return
+		}
+		if last, ok := p._inflight[target]; ok && time.Since(last) < pathCacheTTL {
+			return
+		}
+		p._inflight[target] = time.Now()
+		p._sendLookup(target)
+	})
+}
+
+// _sendLookup emits a TypePathLookup frame towards target along the
+// tree. Each hop that forwards it appends its own incoming switch
+// port to the accumulated path before passing it on, and the frame
+// carries our own key as its Source so that the eventual reply can be
+// routed straight back to us.
+func (p *pathfinder) _sendLookup(target types.PublicKey) {
+	frame := &types.Frame{
+		Type:        types.TypePathLookup,
+		Source:      p.r.public,
+		Destination: target,
+	}
+	var nexthop *peer
+	phony.Block(p.r.state, func() {
+		nexthop, _ = p.r.state._nextHopsFor(nil, frame.Type, target, types.VirtualSnakeWatermark{PublicKey: types.FullMask})
+	})
+	if nexthop == nil || nexthop == p.r.local {
+		return
+	}
+	nexthop.proto.push(frame)
+}
+
+// handleLookup appends our incoming port for from onto the
+// accumulated path and forwards the lookup a hop closer to target, or
+// turns it around into a TypePathNotify once it reaches the target.
+func (p *pathfinder) handleLookup(from *peer, f *types.Frame) error {
+	target, ok := f.Destination.(types.PublicKey)
+	if !ok {
+		return fmt.Errorf("path lookup has non-public-key destination")
+	}
+	path, err := decodeSwitchPorts(f.Payload)
+	if err != nil {
+		return err
+	}
+	path = append(path, from.port)
+
+	if target == p.r.public {
+		p._replyWithNotify(f.Source, path)
+		return nil
+	}
+
+	var nexthop *peer
+	phony.Block(p.r.state, func() {
+		nexthop, _ = p.r.state._nextHopsFor(from, types.TypePathLookup, target, types.VirtualSnakeWatermark{PublicKey: types.FullMask})
+	})
+	if nexthop == nil || nexthop == p.r.local {
+		return nil
+	}
+	nexthop.proto.push(&types.Frame{
+		Type:        types.TypePathLookup,
+		Source:      f.Source,
+		Destination: target,
+		Payload:     encodeSwitchPorts(path),
+	})
+	return nil
+}
+
+// _replyWithNotify turns an arrived lookup around into a
+// TypePathNotify addressed back to origin, carrying the reversed
+// port list so that origin can install a shortcut straight to us.
+func (p *pathfinder) _replyWithNotify(origin net.Addr, path []types.SwitchPortID) {
+	reversed := make([]types.SwitchPortID, len(path))
+	for i, port := range path {
+		reversed[len(path)-1-i] = port
+	}
+	var nexthop *peer
+	phony.Block(p.r.state, func() {
+		nexthop, _ = p.r.state._nextHopsFor(nil, types.TypePathNotify, origin, types.VirtualSnakeWatermark{PublicKey: types.FullMask})
+	})
+	if nexthop == nil {
+		return
+	}
+	nexthop.proto.push(&types.Frame{
+		Type:        types.TypePathNotify,
+		Source:      p.r.public,
+		Destination: origin,
+		Payload:     encodeSwitchPorts(reversed),
+	})
+}
+
+// handleNotify installs a shortcut discovered by a prior lookup,
+// evicting the oldest entry first if the cache is already full.
+func (p *pathfinder) handleNotify(f *types.Frame) error {
+	target, ok := f.Source.(types.PublicKey)
+	if !ok {
+		return fmt.Errorf("path notify has non-public-key source")
+	}
+	ports, err := decodeSwitchPorts(f.Payload)
+	if err != nil {
+		return err
+	}
+	p.Act(nil, func() {
+		delete(p._inflight, target)
+		if len(p._cache) >= pathCacheLimit {
+			p._evictOldest()
+		}
+		p._cache[target] = &cachedPath{
+			ports:   ports,
+			expiry:  time.Now().Add(pathCacheTTL),
+			touched: time.Now(),
+		}
+		p.r._publish(events.PathDiscovered{PublicKey: target, Hops: len(ports)})
+	})
+	return nil
+}
+
+func (p *pathfinder) _evictOldest() {
+	var oldestKey types.PublicKey
+	var oldestTime time.Time
+	first := true
+	for k, path := range p._cache {
+		if first || path.touched.Before(oldestTime) {
+			oldestKey, oldestTime, first = k, path.touched, false
+		}
+	}
+	if !first {
+		delete(p._cache, oldestKey)
+	}
+}
+
+// invalidatePeer drops every cached path whose first hop is the given
+// peer, since it has disconnected and those shortcuts are now dead.
+func (p *pathfinder) invalidatePeer(dead *peer) {
+	p.Act(nil, func() {
+		for target, path := range p._cache {
+			if len(path.ports) > 0 && path.ports[0] == dead.port {
+				delete(p._cache, target)
+			}
+		}
+	})
+}
+
+// encodeSwitchPorts is a small helper used to marshal an accumulated
+// port list into a lookup/notify frame payload.
+func encodeSwitchPorts(ports []types.SwitchPortID) []byte {
+	buf := make([]byte, 0, len(ports)*types.Varu64(0).MaxLength())
+	for _, port := range ports {
+		buf = append(buf, types.Varu64(port).Bytes()...)
+	}
+	return buf
+}
+
+// decodeSwitchPorts parses the port list carried in a
+// TypePathLookup/TypePathNotify frame's payload, the inverse of
+// encodeSwitchPorts.
+func decodeSwitchPorts(payload []byte) ([]types.SwitchPortID, error) {
+	var ports []types.SwitchPortID
+	for len(payload) > 0 {
+		var v types.Varu64
+		n, err := v.UnmarshalBinary(payload)
+		if err != nil {
+			return nil, fmt.Errorf("malformed switch port list: %w", err)
+		}
+		ports = append(ports, types.SwitchPortID(v))
+		payload = payload[n:]
+	}
+	return ports, nil
+}
+
+// handleFrame is the pathfinder's entry point for inbound frames,
+// called from the router's general frame-dispatch path. It routes
+// TypePathLookup/TypePathNotify frames to handleLookup and
+// handleNotify respectively, and reports false for anything else so
+// the caller can fall through to other handlers.
+func (p *pathfinder) handleFrame(from *peer, f *types.Frame) (handled bool, err error) {
+	switch f.Type {
+	case types.TypePathLookup:
+		return true, p.handleLookup(from, f)
+	case types.TypePathNotify:
+		return true, p.handleNotify(f)
+	default:
+		return false, nil
+	}
+}
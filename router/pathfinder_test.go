@@ -0,0 +1,77 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestEncodeDecodeSwitchPortsRoundTrip(t *testing.T) {
+	ports := []types.SwitchPortID{1, 2, 200, 0}
+
+	decoded, err := decodeSwitchPorts(encodeSwitchPorts(ports))
+	if err != nil {
+		t.Fatalf("unexpected error decoding a freshly encoded port list: %v", err)
+	}
+	if !reflect.DeepEqual(decoded, ports) {
+		t.Fatalf("decodeSwitchPorts(encodeSwitchPorts(%v)) = %v", ports, decoded)
+	}
+}
+
+func TestDecodeSwitchPortsEmpty(t *testing.T) {
+	decoded, err := decodeSwitchPorts(nil)
+	if err != nil {
+		t.Fatalf("unexpected error decoding an empty payload: %v", err)
+	}
+	if len(decoded) != 0 {
+		t.Fatalf("expected no ports from an empty payload, got %v", decoded)
+	}
+}
+
+func TestCachedPathExpired(t *testing.T) {
+	live := &cachedPath{expiry: time.Now().Add(time.Minute)}
+	if live.expired() {
+		t.Fatal("expected a path expiring in the future to not be expired")
+	}
+
+	stale := &cachedPath{expiry: time.Now().Add(-time.Minute)}
+	if !stale.expired() {
+		t.Fatal("expected a path whose expiry has passed to be expired")
+	}
+}
+
+func TestPathfinderEvictOldest(t *testing.T) {
+	oldKey := types.PublicKey{0x01}
+	newKey := types.PublicKey{0x02}
+	p := &pathfinder{
+		_cache: map[types.PublicKey]*cachedPath{
+			oldKey: {touched: time.Now().Add(-time.Minute)},
+			newKey: {touched: time.Now()},
+		},
+	}
+
+	p._evictOldest()
+
+	if _, ok := p._cache[oldKey]; ok {
+		t.Fatal("expected the least-recently-touched entry to be evicted")
+	}
+	if _, ok := p._cache[newKey]; !ok {
+		t.Fatal("expected the more recently touched entry to survive eviction")
+	}
+}
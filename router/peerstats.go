@@ -0,0 +1,100 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// statsEMAWeight is the smoothing factor used for the rolling
+// averages kept per peer. A higher weight favours the most recent
+// sample, similar to the EMAs go-ethereum's serverpool keeps per
+// server.
+const statsEMAWeight = 0.2
+
+// rootSequenceKey identifies a single root announcement so that the
+// first time any peer delivers it can be recorded and later compared
+// against when each other peer delivers the same one.
+type rootSequenceKey struct {
+	root types.PublicKey
+	seq  types.Varu64
+}
+
+// peerStats is a rolling set of statistics kept per peer describing
+// the quality of the root announcements it has been delivering,
+// modelled on the kind of scoring go-ethereum's serverpool/LES
+// fetcher use to rank peers. mclock-style monotonic reads (time.Now)
+// are used throughout so a wall-clock jump can't corrupt the EMAs.
+type peerStats struct {
+	phony.Inbox
+	lastAnnouncement time.Time
+	intervalEMA      time.Duration
+	deliveryDelayEMA time.Duration
+	staleCount       uint64
+}
+
+// recordAnnouncement folds a newly received, valid announcement into
+// the peer's statistics: how long it has been since the peer's last
+// announcement, and how far behind the first peer to deliver this
+// particular (root, sequence) it was.
+func (st *peerStats) recordAnnouncement(now time.Time, delay time.Duration) {
+	st.Act(nil, func() {
+		if !st.lastAnnouncement.IsZero() {
+			interval := now.Sub(st.lastAnnouncement)
+			st.intervalEMA = ema(st.intervalEMA, interval)
+		}
+		st.lastAnnouncement = now
+		st.deliveryDelayEMA = ema(st.deliveryDelayEMA, delay)
+	})
+}
+
+// recordStale notes that the peer sent a duplicate or outdated
+// announcement, e.g. one rejected as a replay.
+func (st *peerStats) recordStale() {
+	st.Act(nil, func() {
+		st.staleCount++
+	})
+}
+
+// snapshot returns the exported view of the peer's statistics.
+func (st *peerStats) snapshot() PeerStats {
+	var out PeerStats
+	phony.Block(st, func() {
+		out = PeerStats{
+			AnnouncementInterval: st.intervalEMA,
+			DeliveryDelay:        st.deliveryDelayEMA,
+			StaleCount:           st.staleCount,
+		}
+	})
+	return out
+}
+
+func ema(prev, sample time.Duration) time.Duration {
+	if prev == 0 {
+		return sample
+	}
+	return prev + time.Duration(statsEMAWeight*float64(sample-prev))
+}
+
+// PeerStats is the exported view of a peer's rolling announcement
+// quality, returned by Router.PeerStats().
+type PeerStats struct {
+	AnnouncementInterval time.Duration
+	DeliveryDelay        time.Duration
+	StaleCount           uint64
+}
@@ -0,0 +1,54 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEMASmoothsTowardsNewSamples(t *testing.T) {
+	got := ema(0, time.Second)
+	if got != time.Second {
+		t.Fatalf("expected the first sample to set the EMA outright, got %v", got)
+	}
+
+	got = ema(time.Second, time.Second*2)
+	want := time.Second + time.Duration(statsEMAWeight*float64(time.Second))
+	if got != want {
+		t.Fatalf("ema(%v, %v) = %v, want %v", time.Second, time.Second*2, got, want)
+	}
+}
+
+func TestPeerStatsRecordAnnouncementAndStale(t *testing.T) {
+	st := &peerStats{}
+	now := time.Now()
+
+	st.recordAnnouncement(now, 10*time.Millisecond)
+	st.recordAnnouncement(now.Add(time.Minute), 20*time.Millisecond)
+	st.recordStale()
+	st.recordStale()
+
+	snap := st.snapshot()
+	if snap.StaleCount != 2 {
+		t.Fatalf("expected 2 stale announcements to be recorded, got %d", snap.StaleCount)
+	}
+	if snap.DeliveryDelay <= 10*time.Millisecond || snap.DeliveryDelay >= 20*time.Millisecond {
+		t.Fatalf("expected delivery delay EMA to sit strictly between the two samples, got %v", snap.DeliveryDelay)
+	}
+	if snap.AnnouncementInterval != time.Minute {
+		t.Fatalf("expected the first interval sample to set the EMA outright, got %v", snap.AnnouncementInterval)
+	}
+}
@@ -0,0 +1,357 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"encoding/json"
+	"math/rand"
+	"time"
+
+	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
+	"github.com/matrix-org/pinecone/types"
+)
+
+// marshalPeerInfos and unmarshalPeerInfos encode/decode the address
+// list carried in a TypePeerExchange frame. JSON is good enough here:
+// PEX frames are small, infrequent and not on any hot path.
+func marshalPeerInfos(infos []PeerInfo) ([]byte, error) {
+	return json.Marshal(infos)
+}
+
+func unmarshalPeerInfos(payload []byte) ([]PeerInfo, error) {
+	var infos []PeerInfo
+	if err := json.Unmarshal(payload, &infos); err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+// pexRequestInterval is how often a router asks a random subset of
+// its started peers to share addresses they know about.
+const pexRequestInterval = time.Minute * 5
+
+// pexRequestFanout is the number of started peers asked for addresses
+// on each pexRequestInterval tick.
+const pexRequestFanout = 3
+
+// addressBookLimit bounds the number of addresses remembered across
+// both buckets, oldest-and-least-useful evicted first.
+const addressBookLimit = 1024
+
+// addressBookEntry is a single dial-able candidate peer together with
+// enough history to drive exponential dial backoff, in the same
+// spirit as Tendermint's addrbook.
+type addressBookEntry struct {
+	info      PeerInfo
+	tried     bool
+	failures  int
+	lastTried time.Time
+	lastSeen  time.Time
+}
+
+// backoff returns how long to wait before the next dial attempt,
+// doubling with each consecutive failure up to a one hour ceiling.
+func (e *addressBookEntry) backoff() time.Duration {
+	if e.failures == 0 {
+		return 0
+	}
+	if e.failures >= 12 {
+		// 2^12 seconds is already past the ceiling, and much larger
+		// shifts would overflow.
+		return time.Hour
+	}
+	d := time.Second * time.Duration(int64(1)<<uint(e.failures))
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
+
+func (e *addressBookEntry) readyToDial() bool {
+	return !e.tried || time.Since(e.lastTried) >= e.backoff()
+}
+
+// addressBook is a bounded, actor-guarded store of dial-able peer
+// addresses learned via PEX, split into "tried" and "new" in the same
+// spirit as Tendermint's addrbook so that a flood of unreachable
+// addresses can't crowd out addresses known to work.
+type addressBook struct {
+	phony.Inbox
+	r        *Router
+	_entries map[types.PublicKey]*addressBookEntry
+}
+
+func newAddressBook(r *Router) *addressBook {
+	return &addressBook{r: r, _entries: map[types.PublicKey]*addressBookEntry{}}
+}
+
+// add records info as a dial-able candidate, ignoring entries with an
+// empty URI or public key and entries for ourselves. The URI's scheme
+// is not checked.
+func (b *addressBook) add(info PeerInfo) {
+	if info.URI == "" || info.PublicKey == "" {
+		return
+	}
+	b.Act(nil, func() {
+		pk, err := types.PublicKeyFromString(info.PublicKey)
+		if err != nil || pk == b.r.public {
+			return
+		}
+		if len(b._entries) >= addressBookLimit {
+			b._evictOne()
+		}
+		entry, ok := b._entries[pk]
+		if !ok {
+			entry = &addressBookEntry{}
+			b._entries[pk] = entry
+		}
+		entry.info = info
+		entry.lastSeen = time.Now()
+		b.r._publish(events.PeerDiscovered{PublicKey: pk, URI: info.URI})
+	})
+}
+
+// markDialed records the outcome of a dial attempt against pk so that
+// future candidate selection can back off from addresses that aren't
+// working.
+func (b *addressBook) markDialed(pk types.PublicKey, success bool) {
+	b.Act(nil, func() {
+		entry, ok := b._entries[pk]
+		if !ok {
+			return
+		}
+		entry.tried = true
+		entry.lastTried = time.Now()
+		if success {
+			entry.failures = 0
+		} else {
+			entry.failures++
+		}
+	})
+}
+
+// candidates returns up to n addresses that are currently eligible to
+// be dialled, preferring addresses that haven't been tried yet.
+func (b *addressBook) candidates(n int) []PeerInfo {
+	var picked []PeerInfo
+	phony.Block(b, func() {
+		// Untried addresses are picked first, then tried ones.
+		for _, tried := range []bool{false, true} {
+			for _, entry := range b._entries {
+				if len(picked) >= n {
+					return
+				}
+				if entry.tried == tried && entry.readyToDial() {
+					picked = append(picked, entry.info)
+				}
+			}
+		}
+	})
+	return picked
+}
+
+// snapshot returns every address currently known, for inspection via
+// Router.AddressBook().
+func (b *addressBook) snapshot() []PeerInfo {
+	var all []PeerInfo
+	phony.Block(b, func() {
+		for _, entry := range b._entries {
+			all = append(all, entry.info)
+		}
+	})
+	return all
+}
+
+func (b *addressBook) _evictOne() {
+	var oldestKey types.PublicKey
+	var oldest *addressBookEntry
+	for k, entry := range b._entries {
+		// Entries known to work (tried, last dial succeeded) are only
+		// evicted once no other entry is left; otherwise oldest first.
+		if oldest != nil {
+			works := entry.tried && entry.failures == 0
+			oldestWorks := oldest.tried && oldest.failures == 0
+			if works && !oldestWorks {
+				continue
+			}
+			if works == oldestWorks && !entry.lastSeen.Before(oldest.lastSeen) {
+				continue
+			}
+		}
+		oldestKey, oldest = k, entry
+	}
+	if oldest != nil {
+		delete(b._entries, oldestKey)
+	}
+}
+
+// pexReactor periodically requests peer addresses from a random
+// subset of started peers and folds the replies into the address
+// book, modelled on Tendermint's pex_reactor.
+type pexReactor struct {
+	phony.Inbox
+	r *Router
+}
+
+func newPEXReactor(r *Router) *pexReactor {
+	x := &pexReactor{r: r}
+	go x._run()
+	return x
+}
+
+// _run drives the periodic side of PEX: every pexRequestInterval it
+// asks a random subset of started peers for addresses, until the
+// router shuts down.
+func (x *pexReactor) _run() {
+	ticker := time.NewTicker(pexRequestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-x.r.context.Done():
+			return
+		case <-ticker.C:
+			x._requestFromRandomPeers()
+		}
+	}
+}
+
+// _requestFromRandomPeers asks pexRequestFanout randomly-chosen
+// started peers to share the addresses they know about.
+func (x *pexReactor) _requestFromRandomPeers() {
+	var started []*peer
+	phony.Block(x.r.state, func() {
+		for _, p := range x.r.state._peers {
+			if p != nil && p.started.Load() {
+				started = append(started, p)
+			}
+		}
+	})
+	rand.Shuffle(len(started), func(i, j int) { started[i], started[j] = started[j], started[i] })
+	if len(started) > pexRequestFanout {
+		started = started[:pexRequestFanout]
+	}
+	for _, p := range started {
+		p.proto.push(&types.Frame{Type: types.TypePeerExchange})
+	}
+}
+
+// handleRequest replies to a TypePeerExchange request with our own
+// dial-able peers and known addresses. Inbound-only peers and entries
+// with no dial-able URI are filtered out first, since there's no
+// point advertising an address nobody else could ever dial.
+func (x *pexReactor) handleRequest(from *peer) {
+	var entries []PeerInfo
+	for _, info := range x.r.Peers() {
+		if info.PeerType != int(PeerTypeRemote) || info.URI == "" {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	for _, info := range x.r.addressBook.snapshot() {
+		if info.URI == "" {
+			continue
+		}
+		entries = append(entries, info)
+	}
+	if uri := x.r.natExternalURI(); uri != "" {
+		entries = append(entries, PeerInfo{URI: uri, PublicKey: x.r.public.String()})
+	}
+	payload, err := marshalPeerInfos(entries)
+	if err != nil {
+		return
+	}
+	from.proto.push(&types.Frame{Type: types.TypePeerExchange, Payload: payload})
+}
+
+// handleResponse folds a peer's advertised addresses into our address
+// book.
+func (x *pexReactor) handleResponse(infos []PeerInfo) {
+	for _, info := range infos {
+		x.r.addressBook.add(info)
+	}
+}
+
+// handleFrame is the PEX reactor's entry point for inbound
+// TypePeerExchange frames, called from the router's general frame
+// dispatch. An empty payload is a request for our addresses; a
+// non-empty one is a reply carrying a peer's advertised addresses.
+func (x *pexReactor) handleFrame(from *peer, f *types.Frame) error {
+	if len(f.Payload) == 0 {
+		x.handleRequest(from)
+		return nil
+	}
+	infos, err := unmarshalPeerInfos(f.Payload)
+	if err != nil {
+		return err
+	}
+	x.handleResponse(infos)
+	return nil
+}
+
+// autoConnector keeps at least min outbound, tree-relevant peers
+// connected by dialling candidates from the address book whenever the
+// current count drops below the threshold.
+type autoConnector struct {
+	phony.Inbox
+	r   *Router
+	min int
+}
+
+func newAutoConnector(r *Router) *autoConnector {
+	a := &autoConnector{r: r}
+	go a._run()
+	return a
+}
+
+// _run periodically re-checks the outbound peer count against min,
+// on the same cadence as PEX requests since that's roughly how often
+// the address book gains anything new to dial.
+func (a *autoConnector) _run() {
+	ticker := time.NewTicker(pexRequestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-a.r.context.Done():
+			return
+		case <-ticker.C:
+			a.Act(nil, a._check)
+		}
+	}
+}
+
+func (a *autoConnector) _check() {
+	var outbound int
+	phony.Block(a.r.state, func() {
+		for _, p := range a.r.state._peers {
+			if p != nil && p.started.Load() && p.peertype == PeerTypeRemote {
+				outbound++
+			}
+		}
+	})
+	if outbound >= a.min {
+		return
+	}
+	for _, candidate := range a.r.addressBook.candidates(a.min - outbound) {
+		uri := candidate.URI
+		pk := candidate.PublicKey
+		go func() {
+			_, err := a.r.Connect(uri, ConnectOptions{})
+			if pk, derr := types.PublicKeyFromString(pk); derr == nil {
+				a.r.addressBook.markDialed(pk, err == nil)
+			}
+		}()
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddressBookEntryBackoffDoublesAndCaps(t *testing.T) {
+	e := &addressBookEntry{}
+	if got := e.backoff(); got != 0 {
+		t.Fatalf("expected no backoff before any failure, got %v", got)
+	}
+
+	e.failures = 1
+	if got := e.backoff(); got != time.Second*2 {
+		t.Fatalf("backoff() after 1 failure = %v, want %v", got, time.Second*2)
+	}
+
+	e.failures = 2
+	if got := e.backoff(); got != time.Second*4 {
+		t.Fatalf("backoff() after 2 failures = %v, want %v", got, time.Second*4)
+	}
+
+	e.failures = 20
+	if got := e.backoff(); got != time.Hour {
+		t.Fatalf("expected backoff to cap at an hour, got %v", got)
+	}
+}
+
+func TestAddressBookEntryReadyToDial(t *testing.T) {
+	e := &addressBookEntry{}
+	if !e.readyToDial() {
+		t.Fatal("expected a never-tried entry to be ready to dial")
+	}
+
+	e.tried = true
+	e.failures = 1
+	e.lastTried = time.Now()
+	if e.readyToDial() {
+		t.Fatal("expected an entry to not be ready to dial immediately after a failure")
+	}
+
+	e.lastTried = time.Now().Add(-time.Hour)
+	if !e.readyToDial() {
+		t.Fatal("expected an entry to be ready to dial once its backoff has elapsed")
+	}
+}
@@ -18,9 +18,11 @@ import (
 	"encoding/hex"
 	"fmt"
 	"math"
+	"sort"
 	"time"
 
 	"github.com/Arceliar/phony"
+	"github.com/matrix-org/pinecone/router/events"
 	"github.com/matrix-org/pinecone/types"
 )
 
@@ -45,15 +47,103 @@ func (s *state) _maintainTree() {
 		s._sendTreeAnnouncements()
 	}
 
+	s._sweepExpiredRoots()
+	s._sweepFirstSeen()
 	s._maintainTreeIn(announcementInterval)
 }
 
+// _removePeer is the single place a peer's disconnection must go
+// through: it clears the peer out of _peers and invalidates any
+// pathfinder shortcut that was routing through it, so a stale
+// shortcut can't keep being handed out until its TTL happens to
+// lapse.
+func (s *state) _removePeer(p *peer) {
+	if p == nil {
+		return
+	}
+	if int(p.port) < len(s._peers) && s._peers[p.port] == p {
+		s._peers[p.port] = nil
+	}
+	s.r.pathfinder.invalidatePeer(p)
+}
+
+// _sweepFirstSeen discards first-delivery bookkeeping for root
+// announcements old enough that no peer could still usefully be
+// compared against them.
+func (s *state) _sweepFirstSeen() {
+	cutoff := time.Now().Add(-announcementTimeout)
+	for key, seen := range s._firstSeen {
+		if seen.Before(cutoff) {
+			delete(s._firstSeen, key)
+		}
+	}
+}
+
 type rootAnnouncementWithTime struct {
 	types.SwitchAnnouncement
 	receiveTime  time.Time // when did we receive the update?
 	receiveOrder uint64    // the relative order that the update was received
 }
 
+// expiredRootInfo remembers the highest sequence number we have ever
+// seen for a root key that has since been superseded, along with how
+// long that memory should be kept around for. While the entry is
+// live, an announcement replaying that key at or below the recorded
+// sequence is rejected, which stops a briefly-partitioned node from
+// dragging its peers back to a stale root before the real update
+// propagates.
+type expiredRootInfo struct {
+	seq     types.Varu64
+	expires time.Time
+}
+
+// _recordExpiredRoot notes that root has been superseded, either by a
+// stronger root key or because its announcements timed out. The
+// highest sequence number seen for root is kept so that a later
+// replay of it can be recognised even if this isn't the first time
+// root has expired.
+func (s *state) _recordExpiredRoot(root types.PublicKey, seq types.Varu64) {
+	if s._expiredRoots == nil {
+		s._expiredRoots = map[types.PublicKey]expiredRootInfo{}
+	}
+	if existing, ok := s._expiredRoots[root]; ok && existing.seq > seq {
+		seq = existing.seq
+	}
+	s._expiredRoots[root] = expiredRootInfo{
+		seq:     seq,
+		expires: time.Now().Add(announcementTimeout),
+	}
+}
+
+// _isExpiredRoot returns true if (root, seq) is covered by a still-live
+// expired-root entry, meaning it must be rejected as a stale replay.
+// A lapsed entry is removed so that the root key can be re-accepted
+// following a genuine restart.
+func (s *state) _isExpiredRoot(root types.PublicKey, seq types.Varu64) bool {
+	info, ok := s._expiredRoots[root]
+	if !ok {
+		return false
+	}
+	if time.Now().After(info.expires) {
+		delete(s._expiredRoots, root)
+		return false
+	}
+	return seq <= info.seq
+}
+
+// _sweepExpiredRoots removes expired-root bookkeeping entries whose
+// timeout has lapsed. It is called on every maintenance tick so that
+// the map doesn't grow without bound and so that old root keys become
+// eligible again once enough time has passed.
+func (s *state) _sweepExpiredRoots() {
+	now := time.Now()
+	for root, info := range s._expiredRoots {
+		if now.After(info.expires) {
+			delete(s._expiredRoots, root)
+		}
+	}
+}
+
 func (a *rootAnnouncementWithTime) forPeer(p *peer) *types.Frame {
 	if p == nil || p.port == 0 {
 		return nil
@@ -123,9 +213,13 @@ func (s *state) _becomeRoot() {
 }
 
 func (s *state) sendTreeAnnouncementToPeer(ann *rootAnnouncementWithTime, p *peer) {
-	if peerAnn := ann.forPeer(p); peerAnn != nil {
-		p.proto.push(peerAnn)
+	if p == nil || p._announceQueue == nil {
+		return
 	}
+	// Signing and delivery happen inside the peer's own queue worker,
+	// so this can be called without holding the state actor and a
+	// slow peer can't stall announcements to everyone else.
+	p._announceQueue.enqueue(ann)
 }
 
 func (s *state) _sendTreeAnnouncements() {
@@ -235,10 +329,31 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 
 	if ann := s._announcements[p]; ann != nil {
 		if newUpdate.RootPublicKey == ann.RootPublicKey && newUpdate.Sequence < ann.Sequence {
+			p._stats.recordStale()
 			return fmt.Errorf("update replays old sequence number")
 		}
 	}
 
+	if s._isExpiredRoot(newUpdate.RootPublicKey, newUpdate.Sequence) {
+		p._stats.recordStale()
+		return fmt.Errorf("update replays an expired root announcement")
+	}
+
+	// Track how far behind the first peer to deliver this particular
+	// (root, sequence) pair this peer was, so that _selectNewParent
+	// can prefer peers that consistently deliver root updates first.
+	seqKey := rootSequenceKey{root: newUpdate.RootPublicKey, seq: newUpdate.Sequence}
+	now := time.Now()
+	if s._firstSeen == nil {
+		s._firstSeen = map[rootSequenceKey]time.Time{}
+	}
+	firstSeen, ok := s._firstSeen[seqKey]
+	if !ok {
+		s._firstSeen[seqKey] = now
+		firstSeen = now
+	}
+	p._stats.recordAnnouncement(now, now.Sub(firstSeen))
+
 	lastParentUpdate := s._rootAnnouncement()
 	lastRootKey := s.r.public
 	if lastParentUpdate != nil {
@@ -263,6 +378,7 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 		case rootDelta < 0:
 			fallthrough
 		case rootDelta == 0 && newUpdate.Sequence <= lastParentUpdate.Sequence:
+			s._recordExpiredRoot(lastRootKey, lastParentUpdate.Sequence)
 			s._waiting = true
 			s._becomeRoot()
 
@@ -297,6 +413,7 @@ func (s *state) _handleTreeAnnouncement(p *peer, f *types.Frame) error {
 
 func (s *state) _selectNewParent() bool {
 	root := s._rootAnnouncement()
+	startKey, startSeq := root.RootPublicKey, root.Sequence
 	bestKey := root.RootPublicKey
 	bestSeq := root.Sequence
 	if bestKey.CompareTo(s.r.public) < 0 {
@@ -304,13 +421,30 @@ func (s *state) _selectNewParent() bool {
 		bestSeq = 0
 	}
 	bestOrder := uint64(math.MaxUint64)
+	bestDelay := time.Duration(math.MaxInt64)
 	var bestPeer *peer
 
+	medianDelay := s._medianDeliveryDelay()
+
 	for peer, ann := range s._announcements {
 		if !peer.started.Load() {
 			continue
 		}
-		if ann == nil || time.Since(ann.receiveTime) >= announcementTimeout {
+		if ann == nil {
+			continue
+		}
+		if time.Since(ann.receiveTime) >= announcementTimeout {
+			s._recordExpiredRoot(ann.RootPublicKey, ann.Sequence)
+			continue
+		}
+		if s._isExpiredRoot(ann.RootPublicKey, ann.Sequence) {
+			// A stale replay of a root we've already moved on from.
+			continue
+		}
+		delay := peer._stats.snapshot().DeliveryDelay
+		if medianDelay > 0 && delay > medianDelay*10 {
+			// This peer is consistently far behind the pack in
+			// delivering root updates; don't consider it as a parent.
 			continue
 		}
 		accept := func() {
@@ -318,6 +452,7 @@ func (s *state) _selectNewParent() bool {
 			bestPeer = peer
 			bestOrder = ann.receiveOrder
 			bestSeq = ann.Sequence
+			bestDelay = delay
 		}
 		keyDelta := ann.RootPublicKey.CompareTo(bestKey)
 		switch {
@@ -331,9 +466,13 @@ func (s *state) _selectNewParent() bool {
 			accept()
 		case ann.Sequence < bestSeq:
 			// ignore lower sequence numbers
-		case ann.receiveOrder < bestOrder:
-			// otherwise, pick the parent that sent us the latest root
-			// update first, for the lower latency path to the root
+		case delay < bestDelay:
+			// Prefer the peer that has consistently delivered this
+			// root's updates with the lowest delay relative to the
+			// first peer to deliver each one, rather than going on
+			// the latest single arrival order alone.
+			accept()
+		case delay == bestDelay && ann.receiveOrder < bestOrder:
 			accept()
 		}
 	}
@@ -341,8 +480,12 @@ func (s *state) _selectNewParent() bool {
 	if bestPeer != nil {
 		// Only send tree announcements if the parent actually changed.
 		if bestPeer != s._parent {
+			if bestKey != startKey {
+				s._recordExpiredRoot(startKey, startSeq)
+			}
 			s._parent = bestPeer
 			s._sendTreeAnnouncements()
+			s.r._publish(events.ParentChanged{Reason: "new root announcement selected a better parent"})
 			return true
 		}
 		return false
@@ -354,6 +497,24 @@ func (s *state) _selectNewParent() bool {
 	return false
 }
 
+// _medianDeliveryDelay returns the median delivery-delay EMA across
+// all peers we currently have a live announcement from, used to spot
+// peers that are consistent outliers.
+func (s *state) _medianDeliveryDelay() time.Duration {
+	var delays []time.Duration
+	for peer, ann := range s._announcements {
+		if ann == nil || !peer.started.Load() || time.Since(ann.receiveTime) >= announcementTimeout {
+			continue
+		}
+		delays = append(delays, peer._stats.snapshot().DeliveryDelay)
+	}
+	if len(delays) == 0 {
+		return 0
+	}
+	sort.Slice(delays, func(i, j int) bool { return delays[i] < delays[j] })
+	return delays[len(delays)/2]
+}
+
 func (s *state) _ancestors() ([]types.PublicKey, *peer) {
 	root, parent := s._rootAnnouncement(), s._parent
 	if parent == nil {
@@ -0,0 +1,70 @@
+// Copyright 2021 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package router
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/pinecone/types"
+)
+
+func TestExpiredRootRejectsReplayWhileLive(t *testing.T) {
+	s := &state{}
+	root := types.PublicKey{0x01}
+	s._recordExpiredRoot(root, types.Varu64(5))
+
+	if !s._isExpiredRoot(root, types.Varu64(5)) {
+		t.Fatal("expected a replay of the exact expired sequence to be rejected")
+	}
+	if !s._isExpiredRoot(root, types.Varu64(3)) {
+		t.Fatal("expected a replay of a lower sequence to be rejected")
+	}
+	if s._isExpiredRoot(root, types.Varu64(6)) {
+		t.Fatal("expected a genuinely newer sequence to be accepted")
+	}
+}
+
+func TestExpiredRootKeepsHighestSequenceSeen(t *testing.T) {
+	s := &state{}
+	root := types.PublicKey{0x02}
+	s._recordExpiredRoot(root, types.Varu64(10))
+	// A later, lower sequence for the same root shouldn't regress the bar.
+	s._recordExpiredRoot(root, types.Varu64(4))
+
+	if !s._isExpiredRoot(root, types.Varu64(10)) {
+		t.Fatal("expected the highest sequence ever recorded for root to still be enforced")
+	}
+}
+
+func TestExpiredRootReacceptedAfterSweep(t *testing.T) {
+	s := &state{}
+	root := types.PublicKey{0x03}
+	s._recordExpiredRoot(root, types.Varu64(1))
+
+	// Simulate enough time passing for the entry to lapse.
+	entry := s._expiredRoots[root]
+	entry.expires = time.Now().Add(-time.Second)
+	s._expiredRoots[root] = entry
+
+	s._sweepExpiredRoots()
+
+	if s._isExpiredRoot(root, types.Varu64(1)) {
+		t.Fatal("expected a lapsed expired-root entry to be swept, allowing a genuine restart to reconnect")
+	}
+	if _, ok := s._expiredRoots[root]; ok {
+		t.Fatal("expected the swept entry to be removed from the map")
+	}
+}